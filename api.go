@@ -1,6 +1,8 @@
 package loraserver
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -8,15 +10,45 @@ import (
 	"net/http"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loraserver/internal/retention"
 	"github.com/brocaar/lorawan"
+	"github.com/jmoiron/sqlx"
 )
 
+// defaultRPCTimeout bounds a JSON-RPC call when neither the client sends an
+// X-RPC-Timeout header nor SetDefaultDeadline has configured one.
+const defaultRPCTimeout = 30 * time.Second
+
+// rpcTimeoutHeader lets a client bound an individual RPC, overriding the
+// handler's default timeout for the duration of that call.
+const rpcTimeoutHeader = "X-RPC-Timeout"
+
+// rpcDocsResponse is served from the JSON-RPC handler's GET endpoint. It
+// extends the plain rpcServiceDoc listing with the network-server's version
+// and currently enabled capabilities, so that peers negotiating a rolling
+// upgrade can tell what schema they're talking to before issuing any calls.
+type rpcDocsResponse struct {
+	Version      string                   `json:"version"`
+	Capabilities []Capability             `json:"capabilities"`
+	Services     map[string]rpcServiceDoc `json:"services"`
+}
+
 // JSONRPCHandler implements a http.Handler compatible JSON-RPC handler.
+// Once the client disconnects or the request's timeout (X-RPC-Timeout, or
+// the handler's default) expires, reads of the request body and writes of
+// the response that have not started yet fail. A read, write or DB/Redis
+// call already in progress is not interrupted, and ServeHTTP returns only
+// after the call has finished.
 type JSONRPCHandler struct {
 	server *rpc.Server
 	docs   map[string]rpcServiceDoc
+
+	mu             sync.RWMutex
+	defaultTimeout time.Duration
 }
 
 // NewJSONRPCHandler creates a new JSONRPCHandler.
@@ -31,27 +63,136 @@ func NewJSONRPCHandler(srvcs ...interface{}) (http.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &JSONRPCHandler{s, docs}, nil
+	return &JSONRPCHandler{
+		server:         s,
+		docs:           docs,
+		defaultTimeout: defaultRPCTimeout,
+	}, nil
+}
+
+// SetDefaultDeadline sets the timeout applied to RPCs that don't set the
+// X-RPC-Timeout header. A zero d disables the default timeout.
+func (h *JSONRPCHandler) SetDefaultDeadline(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.defaultTimeout = d
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (h *JSONRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		enc := json.NewEncoder(w)
-		if err := enc.Encode(h.docs); err != nil {
+		doc := rpcDocsResponse{
+			Version:      Version,
+			Capabilities: EnabledCapabilities(),
+			Services:     h.docs,
+		}
+		if err := enc.Encode(doc); err != nil {
 			log.Errorf("could not marshal rpc docs to json: %s", err)
 		}
 		return
 	}
 
+	ctx := r.Context()
+	if timeout, ok := parseRPCTimeoutHeader(r.Header.Get(rpcTimeoutHeader)); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	} else if h.defaultTimeoutDuration() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.defaultTimeoutDuration())
+		defer cancel()
+	}
+
+	// Tie ctx (client disconnect, X-RPC-Timeout, the default timeout) into
+	// conn, so a Read/Write that hasn't started yet is rejected once ctx is
+	// done instead of being attempted against a request that's already
+	// timed out. This only short-circuits calls that haven't begun: a
+	// Read/Write already blocked inside r.Body/w isn't interrupted by ctx
+	// firing, and a handler stalled purely in a DB/Redis call (never
+	// touching conn) can't be interrupted at all, since net/rpc's method
+	// signatures don't accept a context to propagate into storage calls.
+	cancelReader := cancelableReader{ReadCloser: r.Body, done: ctx.Done()}
+	cancelWriter := cancelableWriter{Writer: w, done: ctx.Done()}
+
 	conn := struct {
 		io.Writer
 		io.ReadCloser
-	}{w, r.Body}
+	}{cancelWriter, cancelReader}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.server.ServeRequest(jsonrpc.NewServerCodec(conn))
+	}()
+
+	// Once cancelled, wait for the ServeRequest goroutine to actually return
+	// before handing control back to net/http: returning early would leave
+	// it free to keep reading r.Body or writing to w after the ResponseWriter
+	// is no longer valid. That wait only resolves promptly when the stall is
+	// in the connection I/O (see the comment on conn above); a goroutine
+	// stuck in a DB/Redis call runs until that call returns on its own.
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("could not handle json-rpc request: %s", err)
+		}
+	case <-ctx.Done():
+		log.Warnf("json-rpc request aborted: %s", ctx.Err())
+		<-done
+	}
+}
+
+func (h *JSONRPCHandler) defaultTimeoutDuration() time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.defaultTimeout
+}
 
-	if err := h.server.ServeRequest(jsonrpc.NewServerCodec(conn)); err != nil {
-		log.Errorf("could not handle json-rpc request: %s", err)
+// parseRPCTimeoutHeader parses the X-RPC-Timeout header (a Go duration
+// string, e.g. "500ms" or "2s"). ok is false when the header is absent or
+// malformed, in which case the caller should fall back to the handler's
+// default deadline.
+func parseRPCTimeoutHeader(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, false
 	}
+	return d, true
+}
+
+// cancelableReader rejects a Read that hasn't started yet once done is
+// closed. It does not interrupt a Read already blocked inside ReadCloser.
+type cancelableReader struct {
+	io.ReadCloser
+	done <-chan struct{}
+}
+
+func (c cancelableReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, fmt.Errorf("json-rpc: request context done")
+	default:
+	}
+	return c.ReadCloser.Read(p)
+}
+
+// cancelableWriter rejects a Write that hasn't started yet once done is
+// closed. It does not interrupt a Write already blocked inside Writer.
+type cancelableWriter struct {
+	io.Writer
+	done <-chan struct{}
+}
+
+func (c cancelableWriter) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, fmt.Errorf("json-rpc: request context done")
+	default:
+	}
+	return c.Writer.Write(p)
 }
 
 // GetApplicationsRequest represents the GetApplications request.
@@ -224,3 +365,306 @@ func (a *API) GetRandomDevAddr(dummy *string, devAddr *lorawan.DevAddr) error {
 	*devAddr, err = GetRandomDevAddr(a.ctx.RedisPool, a.ctx.NetID)
 	return err
 }
+
+// GetNodeUplinkHistoryRequest represents the GetNodeUplinkHistory request.
+type GetNodeUplinkHistoryRequest struct {
+	DevEUI lorawan.EUI64 `json:"devEUI"`
+	Since  time.Time     `json:"since"`
+	Until  time.Time     `json:"until"`
+	Limit  int           `json:"limit"`
+}
+
+// GetNodeMetricsRequest represents the GetNodeMetrics request.
+type GetNodeMetricsRequest struct {
+	DevEUI      lorawan.EUI64         `json:"devEUI"`
+	Since       time.Time             `json:"since"`
+	Until       time.Time             `json:"until"`
+	Aggregation retention.Aggregation `json:"aggregation"`
+}
+
+// requireRetention returns an error unless this build understands the
+// retention RPCs *and* a.ctx.Retention is actually configured: the error
+// from requireCapability when RetentionCapability is not enabled, and
+// ErrUnsupportedCapability when a.ctx.Retention is nil. RetentionCapability is enabled process-wide by this
+// package's init(), so it only tells a peer the schema is understood, not
+// whether retention storage was wired up for this particular instance -
+// without this check the methods below would dereference a nil
+// a.ctx.Retention whenever it wasn't.
+func (a *API) requireRetention() error {
+	if err := requireCapability(RetentionCapability); err != nil {
+		return err
+	}
+	if a.ctx.Retention == nil {
+		return ErrUnsupportedCapability
+	}
+	return nil
+}
+
+// GetNodeUplinkHistory returns the retained uplink packet history for the
+// given node within the given time-range.
+func (a *API) GetNodeUplinkHistory(req GetNodeUplinkHistoryRequest, records *[]retention.Record) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	var err error
+	*records, err = a.ctx.Retention.GetUplinkHistory(req.DevEUI, req.Since, req.Until, req.Limit)
+	return err
+}
+
+// GetNodeMetrics returns the downsampled node metrics for the given node
+// within the given time-range.
+func (a *API) GetNodeMetrics(req GetNodeMetricsRequest, metrics *[]retention.Metric) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	var err error
+	*metrics, err = a.ctx.Retention.GetMetrics(req.DevEUI, req.Aggregation, req.Since, req.Until)
+	return err
+}
+
+// CreateRetentionPolicy creates the given retention policy.
+func (a *API) CreateRetentionPolicy(p retention.Policy, name *string) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	if err := a.ctx.Retention.CreatePolicy(p); err != nil {
+		return err
+	}
+	*name = p.Name
+	return nil
+}
+
+// UpdateRetentionPolicy updates the given retention policy.
+func (a *API) UpdateRetentionPolicy(p retention.Policy, name *string) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	if err := a.ctx.Retention.UpdatePolicy(p); err != nil {
+		return err
+	}
+	*name = p.Name
+	return nil
+}
+
+// DeleteRetentionPolicy deletes the retention policy matching the given
+// name.
+func (a *API) DeleteRetentionPolicy(name string, deletedName *string) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	if err := a.ctx.Retention.DeletePolicy(name); err != nil {
+		return err
+	}
+	*deletedName = name
+	return nil
+}
+
+// ListRetentionPolicies returns the configured retention policies.
+func (a *API) ListRetentionPolicies(dummy string, policies *[]retention.Policy) error {
+	if err := a.requireRetention(); err != nil {
+		return err
+	}
+	var err error
+	*policies, err = a.ctx.Retention.GetPolicies()
+	return err
+}
+
+// BatchItemError describes a single item that failed during a batch
+// operation. Unlike a plain error return, it lets the rest of the batch
+// succeed instead of aborting on the first bad record.
+type BatchItemError struct {
+	Index  int           `json:"index"`
+	DevEUI lorawan.EUI64 `json:"devEUI"`
+	Err    string        `json:"error"`
+}
+
+// CreateNodesBatchRequest represents the CreateNodesBatch request.
+type CreateNodesBatchRequest struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// CreateNodesBatchResponse represents the CreateNodesBatch response.
+type CreateNodesBatchResponse struct {
+	Errors []BatchItemError `json:"errors"`
+}
+
+// CreateNodesBatch creates the given nodes in a single transaction. Each
+// node is wrapped in its own savepoint, so a node that fails validation
+// rolls back only its own statements and is recorded in the response's
+// Errors slice rather than aborting the remaining items or the whole
+// transaction - operators onboarding thousands of devices from a CSV don't
+// lose an entire batch over one bad row, but the batch still commits (or
+// rolls back entirely on an infrastructure failure) as one transaction.
+// Trade-off: the transaction (and any row locks it takes) stays open for
+// the whole batch instead of being released per node, so very large batches
+// hold a pooled connection longer than the previous per-node-transaction
+// approach did.
+func (a *API) CreateNodesBatch(req CreateNodesBatchRequest, resp *CreateNodesBatchResponse) error {
+	tx, err := a.ctx.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction error: %s", err)
+	}
+
+	for i, node := range req.Nodes {
+		if err := createNodeInSavepoint(tx, i, node); err != nil {
+			resp.Errors = append(resp.Errors, BatchItemError{Index: i, DevEUI: node.DevEUI, Err: err.Error()})
+		}
+	}
+
+	return tx.Commit()
+}
+
+// createNodeInSavepoint creates node inside a savepoint scoped to tx, so a
+// failed item can be rolled back on its own while the transaction keeps
+// running for the remaining items.
+func createNodeInSavepoint(tx *sqlx.Tx, index int, node Node) error {
+	savepoint := fmt.Sprintf("create_node_%d", index)
+	if _, err := tx.Exec("savepoint " + savepoint); err != nil {
+		return fmt.Errorf("create savepoint error: %s", err)
+	}
+
+	if err := CreateNode(tx, node); err != nil {
+		if _, rbErr := tx.Exec("rollback to savepoint " + savepoint); rbErr != nil {
+			return fmt.Errorf("%s (rollback to savepoint error: %s)", err, rbErr)
+		}
+		return err
+	}
+
+	_, err := tx.Exec("release savepoint " + savepoint)
+	return err
+}
+
+// CreateNodeSessionsBatchRequest represents the CreateNodeSessionsBatch
+// request.
+type CreateNodeSessionsBatchRequest struct {
+	NodeSessions []NodeSession `json:"nodeSessions"`
+}
+
+// CreateNodeSessionsBatchResponse represents the CreateNodeSessionsBatch
+// response.
+type CreateNodeSessionsBatchResponse struct {
+	Errors []BatchItemError `json:"errors"`
+}
+
+// CreateNodeSessionsBatch creates the given node-sessions. Each session is
+// validated the same way as CreateNodeSession (DevAddr NwkID, existing node
+// and application); sessions that fail validation are reported in the
+// response's Errors slice instead of aborting the remaining items.
+//
+// Unlike CreateNodesBatch, this is not wrapped in a sqlx.Tx: node-sessions
+// are stored in Redis via CreateNodeSession, not in Postgres, so
+// there is no SQL transaction for the batch to share - a failed item is
+// simply skipped and reported rather than rolled back.
+func (a *API) CreateNodeSessionsBatch(req CreateNodeSessionsBatchRequest, resp *CreateNodeSessionsBatchResponse) error {
+	for i, ns := range req.NodeSessions {
+		var devAddr lorawan.DevAddr
+		if err := a.CreateNodeSession(ns, &devAddr); err != nil {
+			resp.Errors = append(resp.Errors, BatchItemError{Index: i, DevEUI: ns.DevEUI, Err: err.Error()})
+		}
+	}
+	return nil
+}
+
+// nodeExportRecord is the JSONL representation of a single exported node.
+type nodeExportRecord struct {
+	DevEUI        lorawan.EUI64     `json:"devEUI"`
+	AppEUI        lorawan.EUI64     `json:"appEUI"`
+	AppKey        lorawan.AES128Key `json:"appKey"`
+	RXDelay       uint8             `json:"rxDelay"`
+	RX1DROffset   uint8             `json:"rx1DROffset"`
+	ChannelListID *int64            `json:"channelListID,omitempty"`
+}
+
+// ExportNodes streams every node as gzip-compressed JSONL to w, one
+// nodeExportRecord per line. It is the counterpart to ImportNodes and is
+// intended for bulk backup / migration between network-server instances.
+//
+// It is an in-process helper, not an RPC method: its io.Writer parameter
+// isn't a shape net/rpc can register, so it isn't hung off the *API
+// receiver passed to NewJSONRPCHandler.
+//
+// Node-sessions have no equivalent export/import: they live in Redis with a
+// TTL rather than in Postgres, so round-tripping them through a backup file
+// would re-create sessions whose expiry no longer matches the original
+// activation time. Re-provisioning sessions after a restore is expected to
+// go through CreateNodeSessionsBatch instead, driven by the operator's own
+// record of which nodes were active.
+func ExportNodes(ctx Context, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	const pageSize = 1000
+	for offset := 0; ; offset += pageSize {
+		nodes, err := GetNodes(ctx.DB, pageSize, offset)
+		if err != nil {
+			gz.Close()
+			return err
+		}
+		if len(nodes) == 0 {
+			break
+		}
+		for _, node := range nodes {
+			rec := nodeExportRecord{
+				DevEUI:        node.DevEUI,
+				AppEUI:        node.AppEUI,
+				AppKey:        node.AppKey,
+				RXDelay:       node.RXDelay,
+				RX1DROffset:   node.RX1DROffset,
+				ChannelListID: node.ChannelListID,
+			}
+			if err := enc.Encode(rec); err != nil {
+				gz.Close()
+				return err
+			}
+		}
+	}
+
+	return gz.Close()
+}
+
+// ImportNodes reads gzip-compressed JSONL previously produced by
+// ExportNodes from r and upserts each node (keyed by DevEUI), so that
+// re-running an import after a partial failure is safe. Per-item failures
+// are returned as BatchItemError and do not stop the import.
+//
+// Like ExportNodes, this is an in-process helper rather than an RPC method:
+// net/rpc can't register a method taking an io.Reader and returning two
+// values.
+func ImportNodes(ctx Context, r io.Reader) ([]BatchItemError, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("open gzip reader error: %s", err)
+	}
+	defer gz.Close()
+
+	var errs []BatchItemError
+	dec := json.NewDecoder(gz)
+	for i := 0; ; i++ {
+		var rec nodeExportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode node record error: %s", err)
+		}
+
+		node := Node{
+			DevEUI:        rec.DevEUI,
+			AppEUI:        rec.AppEUI,
+			AppKey:        rec.AppKey,
+			RXDelay:       rec.RXDelay,
+			RX1DROffset:   rec.RX1DROffset,
+			ChannelListID: rec.ChannelListID,
+		}
+
+		if _, err := GetNode(ctx.DB, node.DevEUI); err == nil {
+			err = UpdateNode(ctx.DB, node)
+		} else {
+			err = CreateNode(ctx.DB, node)
+		}
+		if err != nil {
+			errs = append(errs, BatchItemError{Index: i, DevEUI: node.DevEUI, Err: err.Error()})
+		}
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,129 @@
+package loraserver
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-semver/semver"
+)
+
+// Version is the network-server's schema version, reported by the JSON-RPC
+// docs endpoint and the gRPC Capabilities RPC so peers can detect skew
+// during a rolling upgrade.
+const Version = "1.0.0"
+
+// Capability identifies an optional piece of the network-server's RPC/gRPC
+// surface that may not yet be understood by every peer in a cluster that is
+// being rolled out gradually. It is modeled after etcd's api.Capability.
+type Capability string
+
+// Known capabilities.
+const (
+	// NodeSessionV2Capability marks support for the v2 NodeSession schema.
+	NodeSessionV2Capability Capability = "NodeSessionV2"
+	// ChannelListCapability marks support for per-node channel-lists.
+	ChannelListCapability Capability = "ChannelList"
+	// RetentionCapability marks support for the retention-policy subsystem.
+	RetentionCapability Capability = "Retention"
+)
+
+// ErrUnsupportedCapability is returned by an RPC method when a capability it
+// requires is not enabled in this process's registry, so that older clients
+// get a clean error instead of an unmarshalling failure.
+var ErrUnsupportedCapability = fmt.Errorf("loraserver: unsupported capability")
+
+var capabilityRegistry = struct {
+	sync.RWMutex
+	enabled map[Capability]*semver.Version
+}{
+	enabled: make(map[Capability]*semver.Version),
+}
+
+// supportedCapabilities lists every capability this build of the
+// network-server understands. They are enabled automatically when this
+// package is loaded so that behavior gated on a capability (e.g. per-node
+// channel-lists) keeps working exactly as it did before this
+// capability system was introduced, and so that EnabledCapabilities reports
+// an accurate list no matter which binary (network-server or gRPC
+// api-server) is asking.
+var supportedCapabilities = []Capability{
+	NodeSessionV2Capability,
+	ChannelListCapability,
+	RetentionCapability,
+}
+
+func init() {
+	v := semver.New(Version)
+	for _, c := range supportedCapabilities {
+		EnableCapability(c, v)
+	}
+}
+
+// EnableCapability marks c as enabled as of schema version v and logs the
+// change, so an operator watching the logs during a rolling upgrade sees
+// when a capability takes effect. This is logged here, at the point of
+// mutation, rather than by a separate monitor goroutine polling
+// EnabledCapabilities from Server.Start: the registry is process-local
+// (see the supportedCapabilities doc above), so nothing outside of
+// EnableCapability/DisableCapability itself ever changes it, and a polling
+// goroutine could only report the same transition later than this does.
+func EnableCapability(c Capability, v *semver.Version) {
+	capabilityRegistry.Lock()
+	_, wasEnabled := capabilityRegistry.enabled[c]
+	capabilityRegistry.enabled[c] = v
+	capabilityRegistry.Unlock()
+
+	if !wasEnabled {
+		log.WithFields(log.Fields{"capability": c, "version": v}).Warning("capability enabled")
+	}
+}
+
+// DisableCapability marks c as disabled and logs the change, for the same
+// reason EnableCapability does.
+func DisableCapability(c Capability) {
+	capabilityRegistry.Lock()
+	_, wasEnabled := capabilityRegistry.enabled[c]
+	delete(capabilityRegistry.enabled, c)
+	capabilityRegistry.Unlock()
+
+	if wasEnabled {
+		log.WithField("capability", c).Warning("capability disabled")
+	}
+}
+
+// IsCapabilityEnabled reports whether c is currently enabled.
+func IsCapabilityEnabled(c Capability) bool {
+	capabilityRegistry.RLock()
+	defer capabilityRegistry.RUnlock()
+	_, ok := capabilityRegistry.enabled[c]
+	return ok
+}
+
+// EnabledCapabilities returns the currently enabled capabilities, in no
+// particular order.
+func EnabledCapabilities() []Capability {
+	capabilityRegistry.RLock()
+	defer capabilityRegistry.RUnlock()
+
+	out := make([]Capability, 0, len(capabilityRegistry.enabled))
+	for c := range capabilityRegistry.enabled {
+		out = append(out, c)
+	}
+	return out
+}
+
+// requireCapability returns an error when c is not enabled: its message is
+// ErrUnsupportedCapability's followed by the name of c (it is a new error
+// value, not ErrUnsupportedCapability itself). RPC methods can guard
+// schema-dependent behavior with:
+//
+//	if err := requireCapability(RetentionCapability); err != nil {
+//		return err
+//	}
+func requireCapability(c Capability) error {
+	if !IsCapabilityEnabled(c) {
+		return fmt.Errorf("%s: %s", ErrUnsupportedCapability, c)
+	}
+	return nil
+}
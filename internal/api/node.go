@@ -1,6 +1,9 @@
 package api
 
 import (
+	"io"
+
+	root "github.com/brocaar/loraserver"
 	pb "github.com/brocaar/loraserver/api"
 	"github.com/brocaar/loraserver/internal/loraserver"
 	"github.com/brocaar/loraserver/internal/storage"
@@ -45,10 +48,13 @@ func (a *NodeAPI) Create(ctx context.Context, req *pb.CreateNodeRequest) (*pb.Cr
 		RX1DROffset: uint8(req.Rx1DROffset),
 	}
 	if req.ChannelListID > 0 {
+		if !root.IsCapabilityEnabled(root.ChannelListCapability) {
+			return nil, root.ErrUnsupportedCapability
+		}
 		node.ChannelListID = &req.ChannelListID
 	}
 
-	if err := storage.CreateNode(a.ctx.DB, node); err != nil {
+	if err := storage.CreateNode(ctx, a.ctx.DB, node); err != nil {
 		return nil, err
 	}
 
@@ -62,7 +68,7 @@ func (a *NodeAPI) Get(ctx context.Context, req *pb.GetNodeRequest) (*pb.GetNodeR
 		return nil, err
 	}
 
-	node, err := storage.GetNode(a.ctx.DB, eui)
+	node, err := storage.GetNode(ctx, a.ctx.DB, eui)
 	if err != nil {
 		return nil, err
 	}
@@ -97,11 +103,11 @@ func (a *NodeAPI) Get(ctx context.Context, req *pb.GetNodeRequest) (*pb.GetNodeR
 
 // GetList returns a list of nodes (given a limit and offset).
 func (a *NodeAPI) List(ctx context.Context, req *pb.ListNodeRequest) (*pb.ListNodeResponse, error) {
-	nodes, err := storage.GetNodes(a.ctx.DB, int(req.Limit), int(req.Offset))
+	nodes, err := storage.GetNodes(ctx, a.ctx.DB, int(req.Limit), int(req.Offset))
 	if err != nil {
 		return nil, err
 	}
-	count, err := storage.GetNodesCount(a.ctx.DB)
+	count, err := storage.GetNodesCount(ctx, a.ctx.DB)
 	return a.returnList(count, nodes)
 }
 
@@ -112,11 +118,11 @@ func (a *NodeAPI) ListByAppEUI(ctx context.Context, req *pb.ListNodeByAppEUIRequ
 		return nil, err
 	}
 
-	nodes, err := storage.GetNodesForAppEUI(a.ctx.DB, eui, int(req.Limit), int(req.Offset))
+	nodes, err := storage.GetNodesForAppEUI(ctx, a.ctx.DB, eui, int(req.Limit), int(req.Offset))
 	if err != nil {
 		return nil, err
 	}
-	count, err := storage.GetNodesForAppEUICount(a.ctx.DB, eui)
+	count, err := storage.GetNodesForAppEUICount(ctx, a.ctx.DB, eui)
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +144,7 @@ func (a *NodeAPI) Update(ctx context.Context, req *pb.UpdateNodeRequest) (*pb.Up
 		return nil, err
 	}
 
-	node, err := storage.GetNode(a.ctx.DB, devEUI)
+	node, err := storage.GetNode(ctx, a.ctx.DB, devEUI)
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +159,7 @@ func (a *NodeAPI) Update(ctx context.Context, req *pb.UpdateNodeRequest) (*pb.Up
 		node.ChannelListID = nil
 	}
 
-	if err := storage.UpdateNode(a.ctx.DB, node); err != nil {
+	if err := storage.UpdateNode(ctx, a.ctx.DB, node); err != nil {
 		return nil, err
 	}
 
@@ -167,7 +173,7 @@ func (a *NodeAPI) Delete(ctx context.Context, req *pb.DeleteNodeRequest) (*pb.De
 		return nil, err
 	}
 
-	if err := storage.DeleteNode(a.ctx.DB, eui); err != nil {
+	if err := storage.DeleteNode(ctx, a.ctx.DB, eui); err != nil {
 		return nil, err
 	}
 
@@ -180,12 +186,83 @@ func (a *NodeAPI) FlushTXPayloadQueue(ctx context.Context, req *pb.FlushTXPayloa
 	if err := eui.UnmarshalText([]byte(req.DevEUI)); err != nil {
 		return nil, err
 	}
-	if err := storage.FlushTXPayloadQueue(a.ctx.RedisPool, eui); err != nil {
+	if err := storage.FlushTXPayloadQueue(ctx, a.ctx.RedisPool, eui); err != nil {
 		return nil, err
 	}
 	return &pb.FlushTXPayloadQueueResponse{}, nil
 }
 
+// Capabilities returns the network-server's version and the capabilities it
+// currently has enabled, so a peer can detect schema skew before issuing
+// calls that depend on a capability it doesn't yet support.
+func (a *NodeAPI) Capabilities(ctx context.Context, req *pb.CapabilitiesRequest) (*pb.CapabilitiesResponse, error) {
+	resp := pb.CapabilitiesResponse{
+		Version: root.Version,
+	}
+	for _, c := range root.EnabledCapabilities() {
+		resp.Capabilities = append(resp.Capabilities, string(c))
+	}
+	return &resp, nil
+}
+
+// ImportNodes streams nodes from the client and upserts each one (keyed by
+// DevEUI), sending a result back per item so a client importing thousands
+// of devices from a CSV can report per-row progress/failures without the
+// whole import aborting on the first bad record.
+func (a *NodeAPI) ImportNodes(stream pb.NodeAPI_ImportNodesServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		result := pb.ImportNodeResult{DevEUI: req.DevEUI}
+		if err := importNode(stream.Context(), a.ctx, req); err != nil {
+			result.Error = err.Error()
+		}
+		if err := stream.Send(&result); err != nil {
+			return err
+		}
+	}
+}
+
+func importNode(ctx context.Context, lsCtx loraserver.Context, req *pb.NodeImportRequest) error {
+	var appEUI, devEUI lorawan.EUI64
+	var appKey lorawan.AES128Key
+
+	if err := appEUI.UnmarshalText([]byte(req.AppEUI)); err != nil {
+		return err
+	}
+	if err := devEUI.UnmarshalText([]byte(req.DevEUI)); err != nil {
+		return err
+	}
+	if err := appKey.UnmarshalText([]byte(req.AppKey)); err != nil {
+		return err
+	}
+
+	node := models.Node{
+		DevEUI:      devEUI,
+		AppEUI:      appEUI,
+		AppKey:      appKey,
+		RXDelay:     uint8(req.RxDelay),
+		RX1DROffset: uint8(req.Rx1DROffset),
+	}
+	if req.ChannelListID > 0 {
+		if !root.IsCapabilityEnabled(root.ChannelListCapability) {
+			return root.ErrUnsupportedCapability
+		}
+		node.ChannelListID = &req.ChannelListID
+	}
+
+	if _, err := storage.GetNode(ctx, lsCtx.DB, devEUI); err == nil {
+		return storage.UpdateNode(ctx, lsCtx.DB, node)
+	}
+	return storage.CreateNode(ctx, lsCtx.DB, node)
+}
+
 func (a *NodeAPI) returnList(count int, nodes []models.Node) (*pb.ListNodeResponse, error) {
 	resp := pb.ListNodeResponse{
 		TotalCount: int64(count),
@@ -4,28 +4,45 @@ import (
 	"encoding/base64"
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/loraserver/internal/retention"
 	"github.com/brocaar/loraserver/internal/storage"
 	"github.com/brocaar/loraserver/models"
 	"github.com/brocaar/lorawan"
 )
 
+// downsampleInterval is the interval at which raw retention records are
+// aggregated into the coarser, longer-lived retention policies.
+const downsampleInterval = time.Hour
+
+// sweepInterval is the interval at which expired retention shards are
+// removed from the retention store.
+const sweepInterval = time.Hour
+
 // Server represents a LoRaWAN network-server.
 type Server struct {
-	ctx Context
-	wg  sync.WaitGroup
+	ctx  Context
+	wg   sync.WaitGroup
+	stop chan struct{}
 }
 
 // NewServer creates a new server.
 func NewServer(ctx Context) *Server {
 	return &Server{
-		ctx: ctx,
+		ctx:  ctx,
+		stop: make(chan struct{}),
 	}
 }
 
 // Start starts the server.
 func (s *Server) Start() error {
+	if s.ctx.Retention != nil {
+		if err := registerDefaultRetentionPolicies(s.ctx.Retention); err != nil {
+			return fmt.Errorf("register default retention policies error: %s", err)
+		}
+	}
 	go func() {
 		s.wg.Add(1)
 		defer s.wg.Done()
@@ -41,6 +58,44 @@ func (s *Server) Start() error {
 		defer s.wg.Done()
 		handleTXMACPayloads(s.ctx)
 	}()
+	if s.ctx.Retention != nil {
+		go func() {
+			s.wg.Add(1)
+			defer s.wg.Done()
+			retention.StartSweeper(s.ctx.Retention, sweepInterval, s.stop)
+		}()
+	}
+	go func() {
+		s.wg.Add(1)
+		defer s.wg.Done()
+		downsampleRetention(s.ctx, s.stop)
+	}()
+	return nil
+}
+
+// registerDefaultRetentionPolicies creates each of retention.DefaultPolicies
+// that isn't already configured, so that recordRXPacket's "raw_7d" policy
+// (and the "hourly_1y" policy downsampleRetention rolls up into) exist out
+// of the box instead of requiring an operator to create them by hand first.
+func registerDefaultRetentionPolicies(store retention.Storage) error {
+	existing, err := store.GetPolicies()
+	if err != nil {
+		return err
+	}
+
+	have := make(map[string]bool, len(existing))
+	for _, p := range existing {
+		have[p.Name] = true
+	}
+
+	for _, p := range retention.DefaultPolicies {
+		if have[p.Name] {
+			continue
+		}
+		if err := store.CreatePolicy(p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -56,6 +111,7 @@ func (s *Server) Stop() error {
 	if err := s.ctx.Controller.Close(); err != nil {
 		return fmt.Errorf("close network-controller backend error: %s", err)
 	}
+	close(s.stop)
 
 	log.Info("waiting for pending actions to complete")
 	s.wg.Wait()
@@ -114,6 +170,8 @@ func handleTXMACPayloads(ctx Context) {
 }
 
 func handleRXPacket(ctx Context, rxPacket models.RXPacket) error {
+	recordRXPacket(ctx, rxPacket)
+
 	switch rxPacket.PHYPayload.MHDR.MType {
 	case lorawan.JoinRequest:
 		return validateAndCollectJoinRequestPacket(ctx, rxPacket)
@@ -123,3 +181,69 @@ func handleRXPacket(ctx Context, rxPacket models.RXPacket) error {
 		return fmt.Errorf("unknown MType: %v", rxPacket.PHYPayload.MHDR.MType)
 	}
 }
+
+// recordRXPacket persists the RX packet metadata into the "raw_7d" retention
+// policy. Errors are logged rather than returned, so that a retention
+// storage outage never blocks packet processing. Packets whose MACPayload
+// is not a *lorawan.MACPayload (join-requests) are not recorded.
+func recordRXPacket(ctx Context, rxPacket models.RXPacket) {
+	if ctx.Retention == nil {
+		return
+	}
+
+	macPayload, ok := rxPacket.PHYPayload.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return
+	}
+
+	ns, err := storage.GetNodeSession(ctx.RedisPool, macPayload.FHDR.DevAddr)
+	if err != nil {
+		log.WithField("dev_addr", macPayload.FHDR.DevAddr).Errorf("get node-session for retention record error: %s", err)
+		return
+	}
+
+	rxInfo := rxPacket.RXInfo
+	r := retention.Record{
+		DevEUI:    ns.DevEUI,
+		RSSI:      rxInfo.RSSI,
+		LoRaSNR:   rxInfo.LoRaSNR,
+		DataRate:  rxInfo.DataRate.String(),
+		Frequency: rxInfo.Frequency,
+		FCnt:      macPayload.FHDR.FCnt,
+		Timestamp: rxInfo.Time,
+	}
+	copy(r.GatewayMAC[:], rxInfo.MAC[:])
+
+	if err = ctx.Retention.SaveRecord("raw_7d", r); err != nil {
+		log.WithField("dev_eui", r.DevEUI).Errorf("save retention record error: %s", err)
+	}
+}
+
+// downsampleRetention periodically rolls up the raw retention records into
+// the coarser "hourly_1y" policy until stop is closed.
+func downsampleRetention(ctx Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(downsampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ctx.Retention == nil {
+				continue
+			}
+			if err := downsampleOnce(ctx); err != nil {
+				log.Errorf("downsample retention records error: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func downsampleOnce(ctx Context) error {
+	// Roll up the last complete hour only, so that each hour bucket falls in
+	// a single window and a later run never replaces it with partial data.
+	until := time.Now().Truncate(time.Hour)
+	since := until.Add(-downsampleInterval)
+	return ctx.Retention.Downsample("raw_7d", "hourly_1y", since, until)
+}
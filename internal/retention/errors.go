@@ -0,0 +1,10 @@
+package retention
+
+import "errors"
+
+// Errors returned by the retention package.
+var (
+	ErrUnknownAggregation  = errors.New("retention: unknown aggregation")
+	ErrPolicyNotFound      = errors.New("retention: policy does not exist")
+	ErrPolicyAlreadyExists = errors.New("retention: policy already exists")
+)
@@ -0,0 +1,134 @@
+// Package retention implements storage and expiry of uplink packet history
+// and per-node telemetry collected by the network-server.
+package retention
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brocaar/lorawan"
+)
+
+// Record holds the metadata of a single received uplink packet that is kept
+// around for the duration of the retention policy it was stored under.
+type Record struct {
+	DevEUI     lorawan.EUI64
+	GatewayMAC lorawan.EUI64
+	RSSI       int
+	LoRaSNR    float64
+	DataRate   string
+	Frequency  int
+	FCnt       uint32
+	Timestamp  time.Time
+}
+
+// Aggregation defines the downsampling function used by GetNodeMetrics.
+type Aggregation string
+
+// Available aggregations.
+const (
+	AggregationMean  Aggregation = "MEAN"
+	AggregationMin   Aggregation = "MIN"
+	AggregationMax   Aggregation = "MAX"
+	AggregationCount Aggregation = "COUNT"
+)
+
+// Metric is a single downsampled data-point returned by GetNodeMetrics.
+type Metric struct {
+	Timestamp time.Time
+	RSSI      float64
+	LoRaSNR   float64
+	Count     int
+}
+
+// Policy defines for how long raw and downsampled records are kept.
+// It is modeled after InfluxDB's RetentionPolicyInfo. Expiry is per record:
+// DeleteExpiredShards removes each record once it is older than Duration.
+// ShardGroupDuration is stored with the policy, but neither MemoryStorage
+// nor PostgresStorage groups records into shards by it. ReplicaN mirrors InfluxDB's replication factor and is
+// kept for API compatibility with deployments that shard storage across
+// multiple Postgres replicas.
+type Policy struct {
+	Name               string
+	Duration           time.Duration
+	ShardGroupDuration time.Duration
+	ReplicaN           int
+}
+
+// MarshalBinary encodes the policy so it can be stored in Postgres (bytea)
+// or Redis.
+func (p Policy) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return nil, fmt.Errorf("retention: marshal policy error: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a policy previously encoded with MarshalBinary.
+func (p *Policy) UnmarshalBinary(data []byte) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(p); err != nil {
+		return fmt.Errorf("retention: unmarshal policy error: %s", err)
+	}
+	return nil
+}
+
+// DefaultPolicies are created when the network-server starts, each one whose
+// name is not configured yet.
+var DefaultPolicies = []Policy{
+	{Name: "raw_7d", Duration: 7 * 24 * time.Hour, ShardGroupDuration: 24 * time.Hour, ReplicaN: 1},
+	{Name: "hourly_1y", Duration: 365 * 24 * time.Hour, ShardGroupDuration: 7 * 24 * time.Hour, ReplicaN: 1},
+}
+
+// Storage abstracts the persistence of uplink records and retention
+// policies. The default implementation is backed by Postgres; an in-memory
+// implementation is provided for tests.
+type Storage interface {
+	CreatePolicy(p Policy) error
+	UpdatePolicy(p Policy) error
+	DeletePolicy(name string) error
+	GetPolicies() ([]Policy, error)
+
+	SaveRecord(policy string, r Record) error
+	GetUplinkHistory(devEUI lorawan.EUI64, since, until time.Time, limit int) ([]Record, error)
+	GetMetrics(devEUI lorawan.EUI64, agg Aggregation, since, until time.Time) ([]Metric, error)
+
+	// Downsample aggregates every srcPolicy record timestamped in
+	// [since, until) into one record per device per hour, stored under
+	// dstPolicy. It is called periodically by downsampleRetention in the
+	// network-server to roll raw records up into a coarser, longer-lived
+	// policy.
+	Downsample(srcPolicy, dstPolicy string, since, until time.Time) error
+
+	// DeleteExpiredShards removes all records that fall outside of the
+	// Duration of their policy. It is called by Sweep, which StartSweeper
+	// runs periodically.
+	DeleteExpiredShards(now time.Time) error
+}
+
+// Sweep runs a single pass of shard expiry against store, logging (but not
+// returning) any error so that a failing sweep does not stop future ones.
+func Sweep(store Storage, now time.Time) {
+	if err := store.DeleteExpiredShards(now); err != nil {
+		log.Errorf("retention: delete expired shards error: %s", err)
+	}
+}
+
+// StartSweeper runs Sweep on the given interval until stop is closed. It is
+// intended to be started as a goroutine from Server.Start, next to
+// handleRXPackets.
+func StartSweeper(store Storage, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			Sweep(store, now)
+		case <-stop:
+			return
+		}
+	}
+}